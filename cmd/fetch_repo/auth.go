@@ -0,0 +1,271 @@
+/* Copyright 2024 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file resolves HTTP credentials for module proxies and VCS hosts the
+// same two ways `cmd/go` does: a `.netrc` file, and the newer GOAUTH helper
+// protocol. It lets go_repository reach private proxies (Artifactory,
+// JFrog, GitHub Enterprise, ...) without putting secrets on the Bazel
+// command line. credentialStore itself doesn't know about proxies or VCS;
+// moduleProxyClient.fetch is its only caller today because this tree has
+// no vcs.go yet for HTTPS VCS fetches to wire it into as well.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// netrcLine is one "machine/login/password" record from a .netrc file.
+type netrcLine struct {
+	machine  string
+	login    string
+	password string
+}
+
+// netrcPath returns the default .netrc location: $NETRC if set, otherwise
+// $HOME/.netrc (or %USERPROFILE%\_netrc on Windows), matching
+// cmd/go/internal/auth.
+func netrcPath() string {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+	name := ".netrc"
+	if runtime.GOOS == "windows" {
+		name = "_netrc"
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, name)
+}
+
+// parseNetrc tokenizes a .netrc file. It only understands the tokens
+// `machine`, `login`, and `password`. Parsing stops at a `default` entry,
+// as `go` itself does for proxy authentication; a `macdef` ends the current
+// machine record, so `login`/`password` words in its macro body are ignored
+// up to the next `machine` token.
+func parseNetrc(data []byte) []netrcLine {
+	var lines []netrcLine
+	var cur *netrcLine
+	fields := strings.Fields(string(data))
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 >= len(fields) {
+				continue
+			}
+			if cur != nil {
+				lines = append(lines, *cur)
+			}
+			cur = &netrcLine{machine: fields[i+1]}
+			i++
+		case "login":
+			if cur != nil && i+1 < len(fields) {
+				cur.login = fields[i+1]
+				i++
+			}
+		case "password":
+			if cur != nil && i+1 < len(fields) {
+				cur.password = fields[i+1]
+				i++
+			}
+		case "default":
+			i = len(fields)
+		case "macdef":
+			if cur != nil {
+				lines = append(lines, *cur)
+			}
+			cur = nil
+			i++
+		}
+	}
+	if cur != nil {
+		lines = append(lines, *cur)
+	}
+	return lines
+}
+
+func loadNetrc() []netrcLine {
+	path := netrcPath()
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	return parseNetrc(data)
+}
+
+// credentialStore resolves request credentials from .netrc and GOAUTH, the
+// way `go`'s module downloader and VCS fetches do.
+type credentialStore struct {
+	netrc      []netrcLine
+	goAuthCmds []string
+}
+
+func newCredentialStore() *credentialStore {
+	goauth := os.Getenv("GOAUTH")
+	if goauth == "" {
+		goauth = "netrc"
+	}
+	cs := &credentialStore{}
+	for _, cmd := range strings.Split(goauth, ";") {
+		cmd = strings.TrimSpace(cmd)
+		switch cmd {
+		case "", "off":
+			continue
+		case "netrc":
+			if cs.netrc == nil {
+				cs.netrc = loadNetrc()
+			}
+		default:
+			cs.goAuthCmds = append(cs.goAuthCmds, cmd)
+		}
+	}
+	return cs
+}
+
+// apply sets Authorization (or other GOAUTH-provided) headers on req for
+// the host it targets, trying .netrc first (HTTPS only: a .netrc record is
+// a bare password, so it must never go out over plaintext HTTP) and then
+// each configured GOAUTH command in order, stopping at the first one that
+// supplies credentials.
+func (cs *credentialStore) apply(req *http.Request) {
+	if req.URL.Scheme == "https" {
+		host := req.URL.Hostname()
+		for _, l := range cs.netrc {
+			if l.machine == host {
+				req.SetBasicAuth(l.login, l.password)
+				return
+			}
+		}
+	}
+	for _, cmd := range cs.goAuthCmds {
+		if headers, ok := cs.runGoAuthCmd(cmd, req.URL); ok {
+			for k, v := range headers {
+				req.Header.Set(k, v)
+			}
+			return
+		}
+	}
+}
+
+// runGoAuthCmd resolves one GOAUTH entry. "git" asks the system git
+// credential helper using its documented stdin/stdout protocol; anything
+// else is run as `<cmd> <url>` and is expected to print one or more
+// "Response" blocks to stdout, the format `go help goauth` documents:
+//
+//	Response
+//	URL: <url or url prefix the headers below apply to>
+//	Header: <Name>: <Value>
+//	Header: <Name>: <Value>
+//
+// blocks separated by a blank line. The first block whose URL is a prefix
+// of u's string form is used.
+func (cs *credentialStore) runGoAuthCmd(cmd string, u *url.URL) (map[string]string, bool) {
+	if cmd == "git" {
+		return gitCredentialFill(u)
+	}
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return nil, false
+	}
+	c := exec.Command(fields[0], append(fields[1:], u.String())...)
+	out, err := c.Output()
+	if err != nil {
+		return nil, false
+	}
+	for _, block := range parseGoAuthResponses(out) {
+		if strings.HasPrefix(u.String(), block.url) {
+			return block.headers, len(block.headers) > 0
+		}
+	}
+	return nil, false
+}
+
+// goAuthResponse is one parsed "Response" block from a GOAUTH command.
+type goAuthResponse struct {
+	url     string
+	headers map[string]string
+}
+
+func parseGoAuthResponses(out []byte) []goAuthResponse {
+	var responses []goAuthResponse
+	var cur *goAuthResponse
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "Response":
+			if cur != nil {
+				responses = append(responses, *cur)
+			}
+			cur = &goAuthResponse{headers: map[string]string{}}
+		case line == "":
+			continue
+		case cur == nil:
+			continue
+		case strings.HasPrefix(line, "URL:"):
+			cur.url = strings.TrimSpace(strings.TrimPrefix(line, "URL:"))
+		case strings.HasPrefix(line, "Header:"):
+			header := strings.TrimSpace(strings.TrimPrefix(line, "Header:"))
+			k, v, ok := strings.Cut(header, ":")
+			if ok {
+				cur.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+			}
+		}
+	}
+	if cur != nil {
+		responses = append(responses, *cur)
+	}
+	return responses
+}
+
+func gitCredentialFill(u *url.URL) (map[string]string, bool) {
+	input := fmt.Sprintf("protocol=%s\nhost=%s\npath=%s\n\n", u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/"))
+	cmd := exec.Command("git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(input)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, false
+	}
+	var user, pass string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "username="):
+			user = strings.TrimPrefix(line, "username=")
+		case strings.HasPrefix(line, "password="):
+			pass = strings.TrimPrefix(line, "password=")
+		}
+	}
+	if user == "" && pass == "" {
+		return nil, false
+	}
+	basic := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	return map[string]string{"Authorization": "Basic " + basic}, true
+}
@@ -0,0 +1,243 @@
+/* Copyright 2024 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file lets fetch_repo reuse zips other go_repository rules (or `go`
+// itself) have already downloaded, instead of hitting the network for
+// every rule in a build.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// decodeH1Hex decodes an "h1:<base64>" dirhash sum to a lowercase hex
+// digest, the form repositoryCache's directory layout uses as a key (it
+// borrows Bazel's content_addressable/sha256/<hex>/file directory shape for
+// familiarity, not its hashing scheme).
+func decodeH1Hex(h1Sum string) (string, error) {
+	if !strings.HasPrefix(h1Sum, "h1:") {
+		return "", fmt.Errorf("unsupported hash algorithm in sum %q", h1Sum)
+	}
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(h1Sum, "h1:"))
+	if err != nil {
+		return "", fmt.Errorf("decoding sum %q: %w", h1Sum, err)
+	}
+	return hex.EncodeToString(digest), nil
+}
+
+// downloadCache mirrors the on-disk layout `cmd/go` uses under
+// $GOMODCACHE/cache/download/<path>/@v/: a <version>.zip next to a
+// <version>.ziphash containing the zip's h1: hash. Reusing that layout
+// means fetch_repo and a real `go` binary on the same machine share one
+// cache instead of keeping two.
+type downloadCache struct {
+	root string // $GOMODCACHE/cache/download, or "" if disabled
+}
+
+func newDownloadCache() *downloadCache {
+	gomodcache := os.Getenv("GOMODCACHE")
+	if gomodcache == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return &downloadCache{}
+		}
+		gomodcache = filepath.Join(home, "go", "pkg", "mod")
+	}
+	return &downloadCache{root: filepath.Join(gomodcache, "cache", "download")}
+}
+
+func (c *downloadCache) enabled() bool { return c.root != "" }
+
+func (c *downloadCache) versionDir(importPath string) (string, error) {
+	escaped, err := module.EscapePath(importPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.root, filepath.FromSlash(escaped), "@v"), nil
+}
+
+// lookupZip returns the path to a cached, hash-verified zip for
+// importPath@version, if one is present.
+func (c *downloadCache) lookupZip(importPath, version string) (string, bool) {
+	if !c.enabled() {
+		return "", false
+	}
+	dir, err := c.versionDir(importPath)
+	if err != nil {
+		return "", false
+	}
+	zipPath := filepath.Join(dir, version+".zip")
+	wantHash, err := os.ReadFile(filepath.Join(dir, version+".ziphash"))
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(zipPath); err != nil {
+		return "", false
+	}
+	gotHash, err := dirhash.HashZip(zipPath, dirhash.DefaultHash)
+	if err != nil || gotHash != strings.TrimSpace(string(wantHash)) {
+		return "", false
+	}
+	return zipPath, true
+}
+
+// storeZip writes a freshly downloaded, already-verified zip into the
+// cache so later fetch_repo invocations (and `go` itself) can reuse it.
+// Failures are non-fatal: they just mean the next fetch pays the network
+// cost again.
+func (c *downloadCache) storeZip(importPath, version string, zipData []byte, hash string) {
+	if !c.enabled() {
+		return
+	}
+	dir, err := c.versionDir(importPath)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return
+	}
+	zipPath := filepath.Join(dir, version+".zip")
+	if _, err := os.Stat(zipPath); err == nil {
+		return // another process already populated this entry.
+	}
+	if err := os.WriteFile(zipPath, zipData, 0o444); err != nil {
+		return
+	}
+	os.WriteFile(filepath.Join(dir, version+".ziphash"), []byte(hash), 0o444)
+}
+
+// lookupGoMod returns the cached go.mod contents for importPath@version, if
+// present, the same way `cmd/go` reuses $GOMODCACHE/cache/download/.../@v/
+// <version>.mod across invocations instead of re-fetching it.
+func (c *downloadCache) lookupGoMod(importPath, version string) ([]byte, bool) {
+	if !c.enabled() {
+		return nil, false
+	}
+	dir, err := c.versionDir(importPath)
+	if err != nil {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(dir, version+".mod"))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// storeGoMod writes a freshly fetched go.mod into the cache so later
+// fetch_repo invocations (and `go` itself) can reuse it. Failures are
+// non-fatal: they just mean the next fetch pays the network cost again.
+func (c *downloadCache) storeGoMod(importPath, version string, data []byte) {
+	if !c.enabled() {
+		return
+	}
+	dir, err := c.versionDir(importPath)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return
+	}
+	modPath := filepath.Join(dir, version+".mod")
+	if _, err := os.Stat(modPath); err == nil {
+		return // another process already populated this entry.
+	}
+	os.WriteFile(modPath, data, 0o444)
+}
+
+// repositoryCache is a content-addressable store keyed by the h1: sum from
+// go.sum (a base64-encoded SHA-256 digest of the module's file list, not of
+// the zip bytes themselves) rather than by module path and version. This
+// lets rules from unrelated workspaces that happen to depend on the exact
+// same module version share one cache entry, the same lookup-by-hash idea
+// Bazel's own --repository_cache uses, though the two caches are not
+// byte-compatible: Bazel keys its store by the plain SHA-256 of the
+// downloaded file, which isn't known until after the zip is fetched, so it
+// can't be used to skip the download the way an h1: sum (published by the
+// sumdb ahead of time) can.
+type repositoryCache struct {
+	root string // content_addressable/sha256, or "" if disabled
+}
+
+// repositoryCacheDirEnv names the environment variable go_repository.bzl is
+// expected to set, forwarding a directory for this h1-keyed cache, so
+// fetch_repo can dedupe against it. This tree has no go_repository.bzl yet
+// to pass a -repository_cache flag through instead, so an env var is the
+// wiring available today; runGoModDownload reads it via
+// newRepositoryCacheFromEnv.
+const repositoryCacheDirEnv = "GAZELLE_REPOSITORY_CACHE"
+
+// newRepositoryCache builds a repositoryCache rooted at dir. An empty dir
+// disables it.
+func newRepositoryCache(dir string) *repositoryCache {
+	if dir == "" {
+		return &repositoryCache{}
+	}
+	return &repositoryCache{root: filepath.Join(dir, "content_addressable", "sha256")}
+}
+
+// newRepositoryCacheFromEnv builds a repositoryCache rooted at
+// $GAZELLE_REPOSITORY_CACHE, or a disabled one if that's unset.
+func newRepositoryCacheFromEnv() *repositoryCache {
+	return newRepositoryCache(os.Getenv(repositoryCacheDirEnv))
+}
+
+func (c *repositoryCache) enabled() bool { return c.root != "" }
+
+// keyPath maps an h1: sum to its on-disk path, decoding the base64 SHA-256
+// digest to the hex form Bazel's repository cache uses as a directory name.
+func (c *repositoryCache) keyPath(h1Sum string) (string, error) {
+	hexDigest, err := decodeH1Hex(h1Sum)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(c.root, hexDigest, "file"), nil
+}
+
+func (c *repositoryCache) lookup(h1Sum string) (string, bool) {
+	if !c.enabled() {
+		return "", false
+	}
+	path, err := c.keyPath(h1Sum)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", false
+	}
+	return path, true
+}
+
+func (c *repositoryCache) store(h1Sum string, data []byte) {
+	if !c.enabled() {
+		return
+	}
+	path, err := c.keyPath(h1Sum)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return
+	}
+	os.WriteFile(path, data, 0o444)
+}
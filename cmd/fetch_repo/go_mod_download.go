@@ -1,16 +1,13 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"go/build"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"runtime"
-	"strings"
+
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/sumdb/dirhash"
+	modzip "golang.org/x/mod/zip"
 )
 
 type GoModDownloadResult struct {
@@ -19,75 +16,129 @@ type GoModDownloadResult struct {
 	Error string
 }
 
-func isModeCacherwSupported() bool {
-	// Check whether -modcacherw is supported.
-	// Assume that fetch_repo was built with the same version of Go we're running.
-	modcacherw := false
-	for _, tag := range build.Default.ReleaseTags {
-		if tag == "go1.14" {
-			modcacherw = true
-			break
-		}
+// runGoModDownload fetches importpath@version directly from a GOPROXY-aware
+// HTTP client and unpacks it into dest, without shelling out to `go mod
+// download`. This avoids requiring a working `go` binary in the repository
+// rule sandbox and lets callers fetch modules concurrently within a single
+// fetch_repo invocation.
+func runGoModDownload(dl *GoModDownloadResult, dest string, importpath string, version string) error {
+	if importpath == "" || version == "" {
+		dl.Error = "importpath and version are required"
+		return errors.New(dl.Error)
 	}
 
-	return modcacherw
-}
-func findGoPath() string {
-	// Locate the go binary. If GOROOT is set, we'll use that one; otherwise,
-	// we'll use PATH.
-	goPath := "go"
-	if runtime.GOOS == "windows" {
-		goPath += ".exe"
-	}
-	if goroot, ok := os.LookupEnv("GOROOT"); ok {
-		goPath = filepath.Join(goroot, "bin", goPath)
+	if replaced, err := moduleFromLocalReplaceEnv(dest); err != nil {
+		dl.Error = err.Error()
+		return err
+	} else if replaced {
+		dl.Dir = dest
+		fmt.Printf("Using local replace: %s@%s\n", importpath, version)
+		return nil
 	}
-	return goPath
-}
 
-func runGoModDownload(dl *GoModDownloadResult, dest string, importpath string, version string) error {
-	buf := &bytes.Buffer{}
-	bufErr := &bytes.Buffer{}
-	cmd := exec.Command(findGoPath(), "mod", "download", "-json")
-	cmd.Dir = dest
-	if isModeCacherwSupported() {
-		cmd.Args = append(cmd.Args, "-modcacherw")
+	if vendored, err := moduleFromVendorEnv(dest, importpath, version); err != nil {
+		dl.Error = err.Error()
+		return err
+	} else if vendored {
+		dl.Dir = dest
+		fmt.Printf("Using vendored: %s@%s\n", importpath, version)
+		return nil
 	}
 
-	if version != "" && importpath != "" {
-		cmd.Args = append(cmd.Args, importpath+"@"+version)
-	}
+	proxy := newModuleProxyClient()
+	sum := newSumDBVerifier()
+	cache := newDownloadCache()
+	repoCache := newRepositoryCacheFromEnv()
 
-	cmd.Stdout = buf
-	cmd.Stderr = bufErr
-	fmt.Printf("Running: %s %s\n", cmd.Path, strings.Join(cmd.Args, " "))
-	dlErr := cmd.Run()
-	if dlErr != nil {
-		if _, ok := dlErr.(*exec.ExitError); !ok {
-			if bufErr.Len() > 0 {
-				return fmt.Errorf("%s %s: %s", cmd.Path, strings.Join(cmd.Args, " "), bufErr.Bytes())
-			} else {
-				return fmt.Errorf("%s %s: %v", cmd.Path, strings.Join(cmd.Args, " "), dlErr)
+	var hash string
+	zipPath, cached := cache.lookupZip(importpath, version)
+	if !cached {
+		// A trusted hash from the sumdb lets us check the content-addressable
+		// repository cache before downloading the zip.
+		if expected, ok, err := sum.expectedZipSum(importpath, version); err == nil && ok {
+			if path, hit := repoCache.lookup(expected); hit {
+				if got, err := dirhash.HashZip(path, dirhash.DefaultHash); err == nil && got == expected {
+					zipPath, hash, cached = path, got, true
+				}
 			}
 		}
 	}
-
-	// Parse the JSON output.
-	if err := json.Unmarshal(buf.Bytes(), &dl); err != nil {
-		if bufErr.Len() > 0 {
-			return fmt.Errorf("%s %s: %s", cmd.Path, strings.Join(cmd.Args, " "), bufErr.Bytes())
-		} else {
-			return fmt.Errorf("%s %s: %v", cmd.Path, strings.Join(cmd.Args, " "), err)
+	if !cached {
+		var err error
+		zipPath, hash, err = fetchZip(proxy, sum, importpath, version)
+		if err != nil {
+			dl.Error = err.Error()
+			return err
 		}
+		defer os.Remove(zipPath)
+		if zipData, readErr := os.ReadFile(zipPath); readErr == nil {
+			cache.storeZip(importpath, version, zipData, hash)
+			repoCache.store(hash, zipData)
+		}
+	} else {
+		fmt.Printf("Using cached: %s@%s\n", importpath, version)
+		h, err := dirhash.HashZip(zipPath, dirhash.DefaultHash)
+		if err != nil {
+			return err
+		}
+		hash = h
 	}
-	if dl.Error != "" {
-		return errors.New(dl.Error)
-	}
-	if dlErr != nil {
-		return dlErr
+
+	mod := module.Version{Path: importpath, Version: version}
+	if err := modzip.Unzip(dest, mod, zipPath); err != nil {
+		dl.Error = err.Error()
+		return fmt.Errorf("%s@%s: unpacking module zip: %w", importpath, version, err)
 	}
 
+	dl.Dir = dest
+	dl.Sum = hash
 	fmt.Printf("Downloaded: %s\n", dl.Dir)
 
 	return nil
 }
+
+// fetchZip downloads and sumdb-verifies importpath@version's go.mod and
+// zip, writing the zip to a temporary file and returning its path and h1:
+// hash.
+func fetchZip(proxy *moduleProxyClient, sum *sumdbVerifier, importpath, version string) (zipPath string, hash string, err error) {
+	fmt.Printf("Fetching: %s@%s\n", importpath, version)
+
+	modData, err := proxy.goMod(importpath, version)
+	if err != nil {
+		return "", "", fmt.Errorf("%s@%s: %w", importpath, version, err)
+	}
+	if err := sum.verifyGoMod(importpath, version, modData); err != nil {
+		return "", "", err
+	}
+
+	zipData, err := proxy.zip(importpath, version)
+	if err != nil {
+		return "", "", fmt.Errorf("%s@%s: %w", importpath, version, err)
+	}
+
+	zipFile, err := os.CreateTemp("", "fetch_repo-*.zip")
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := zipFile.Write(zipData); err != nil {
+		zipFile.Close()
+		os.Remove(zipFile.Name())
+		return "", "", err
+	}
+	if err := zipFile.Close(); err != nil {
+		os.Remove(zipFile.Name())
+		return "", "", err
+	}
+
+	if err := sum.verifyZip(importpath, version, zipFile.Name()); err != nil {
+		os.Remove(zipFile.Name())
+		return "", "", err
+	}
+
+	hash, err = dirhash.HashZip(zipFile.Name(), dirhash.DefaultHash)
+	if err != nil {
+		os.Remove(zipFile.Name())
+		return "", "", err
+	}
+	return zipFile.Name(), hash, nil
+}
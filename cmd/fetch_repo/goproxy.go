@@ -0,0 +1,245 @@
+/* Copyright 2024 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file implements a minimal, in-process module proxy client modeled on
+// the resolution rules documented for `cmd/go` (see `go help goproxy`). It
+// lets fetch_repo download modules without shelling out to a `go` binary.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/mod/module"
+)
+
+// moduleInfo mirrors the JSON object returned by a proxy's
+// .../@v/<version>.info endpoint.
+type moduleInfo struct {
+	Version string
+	Time    string
+}
+
+// proxySpec is one entry of a GOPROXY list: either a URL, or one of the
+// sentinels "direct"/"off". fallbackAlways is true when this entry is
+// followed by a pipe (fall back on any error); when false it is followed
+// by a comma, meaning fall back only on a 404/410 "not found" response.
+type proxySpec struct {
+	value          string
+	fallbackAlways bool
+}
+
+// parseGoProxy splits a GOPROXY value into its ordered list of entries,
+// honoring the comma ("fall back only on not-found") and pipe ("fall back
+// on any error") separators.
+func parseGoProxy(env string) []proxySpec {
+	if env == "" {
+		env = "https://proxy.golang.org,direct"
+	}
+	var specs []proxySpec
+	fallbackAlways := true
+	for _, field := range strings.FieldsFunc(env, func(r rune) bool { return r == ',' || r == '|' }) {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		specs = append(specs, proxySpec{value: field, fallbackAlways: fallbackAlways})
+	}
+	// Recompute fallbackAlways per-entry by re-scanning separators, since
+	// FieldsFunc discards them.
+	i := 0
+	for _, sep := range env {
+		if sep != ',' && sep != '|' {
+			continue
+		}
+		if i >= len(specs) {
+			break
+		}
+		specs[i].fallbackAlways = sep == '|'
+		i++
+	}
+	return specs
+}
+
+// matchesGlobList reports whether importPath matches any of the
+// comma-separated glob patterns in list, the same way `cmd/go` matches
+// GOPRIVATE/GONOPROXY/GONOSUMCHECK: a pattern matches not just importPath
+// itself but every module path nested under it, at any depth.
+func matchesGlobList(importPath, list string) bool {
+	return module.MatchPrefixPatterns(list, importPath)
+}
+
+// goEnv captures the subset of the `go` environment variables that affect
+// module fetching.
+type goEnv struct {
+	proxy      string
+	private    string // GOPRIVATE
+	noproxy    string // GONOPROXY, falls back to GOPRIVATE
+	nosumcheck string // GONOSUMCHECK, falls back to GOPRIVATE
+	sumdb      string // GOSUMDB
+	nosumdb    string // GONOSUMDB, falls back to GONOSUMCHECK
+}
+
+func readGoEnv() goEnv {
+	private := os.Getenv("GOPRIVATE")
+	noproxy := os.Getenv("GONOPROXY")
+	if noproxy == "" {
+		noproxy = private
+	}
+	nosumcheck := os.Getenv("GONOSUMCHECK")
+	if nosumcheck == "" {
+		nosumcheck = private
+	}
+	nosumdb := os.Getenv("GONOSUMDB")
+	if nosumdb == "" {
+		nosumdb = nosumcheck
+	}
+	return goEnv{
+		proxy:      os.Getenv("GOPROXY"),
+		private:    private,
+		noproxy:    noproxy,
+		nosumcheck: nosumcheck,
+		sumdb:      os.Getenv("GOSUMDB"),
+		nosumdb:    nosumdb,
+	}
+}
+
+// moduleProxyClient fetches module metadata and zips directly over HTTP,
+// following the GOPROXY fallback rules instead of shelling out to `go`.
+type moduleProxyClient struct {
+	env    goEnv
+	creds  *credentialStore
+	client *http.Client
+}
+
+func newModuleProxyClient() *moduleProxyClient {
+	return &moduleProxyClient{
+		env:    readGoEnv(),
+		creds:  newCredentialStore(),
+		client: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+// proxiesFor returns the ordered proxy list to use for importPath, honoring
+// GONOPROXY/GOPRIVATE.
+func (c *moduleProxyClient) proxiesFor(importPath string) []proxySpec {
+	if c.env.noproxy != "" && matchesGlobList(importPath, c.env.noproxy) {
+		return []proxySpec{{value: "direct", fallbackAlways: true}}
+	}
+	return parseGoProxy(c.env.proxy)
+}
+
+// get requests urlSuffix (escaped module path already applied by the
+// caller) against each configured proxy in turn, honoring fallback rules.
+// It returns the first successful response body.
+func (c *moduleProxyClient) get(importPath, urlSuffix string) ([]byte, error) {
+	specs := c.proxiesFor(importPath)
+	var lastErr error
+	for _, spec := range specs {
+		switch spec.value {
+		case "off":
+			return nil, fmt.Errorf("module %s: disabled by GOPROXY=off", importPath)
+		case "direct":
+			body, err := c.getDirect(importPath, urlSuffix)
+			if err == nil {
+				return body, nil
+			}
+			lastErr = err
+			continue
+		default:
+			escaped, err := module.EscapePath(importPath)
+			if err != nil {
+				return nil, fmt.Errorf("module %s: %w", importPath, err)
+			}
+			base := strings.TrimSuffix(spec.value, "/")
+			reqURL := base + "/" + escaped + urlSuffix
+			body, status, err := c.fetch(reqURL)
+			if err == nil {
+				return body, nil
+			}
+			lastErr = err
+			if !spec.fallbackAlways && status != http.StatusNotFound && status != http.StatusGone {
+				return nil, err
+			}
+			continue
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("module %s: no GOPROXY entries configured", importPath)
+	}
+	return nil, lastErr
+}
+
+func (c *moduleProxyClient) fetch(reqURL string) ([]byte, int, error) {
+	u, err := url.Parse(reqURL)
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	c.creds.apply(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("GET %s: %w", reqURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("GET %s: %w", reqURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode, fmt.Errorf("GET %s: %s: %s", reqURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, resp.StatusCode, nil
+}
+
+// getDirect handles the "direct" GOPROXY sentinel. Full support means
+// resolving and fetching directly from the module's version control
+// system, as proxy.golang.org itself does; that VCS-fetch path isn't
+// implemented here yet.
+func (c *moduleProxyClient) getDirect(importPath, urlSuffix string) ([]byte, error) {
+	return nil, fmt.Errorf("module %s: GOPROXY=direct is not yet supported by fetch_repo", importPath)
+}
+
+// info fetches the .info record for importPath@version.
+func (c *moduleProxyClient) info(importPath, version string) (*moduleInfo, error) {
+	body, err := c.get(importPath, "/@v/"+version+".info")
+	if err != nil {
+		return nil, err
+	}
+	info := &moduleInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, fmt.Errorf("module %s@%s: parsing .info: %w", importPath, version, err)
+	}
+	return info, nil
+}
+
+// goMod fetches the go.mod file contents for importPath@version.
+func (c *moduleProxyClient) goMod(importPath, version string) ([]byte, error) {
+	return c.get(importPath, "/@v/"+version+".mod")
+}
+
+// zip fetches the module zip for importPath@version.
+func (c *moduleProxyClient) zip(importPath, version string) ([]byte, error) {
+	return c.get(importPath, "/@v/"+version+".zip")
+}
@@ -0,0 +1,144 @@
+/* Copyright 2024 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file backs a `-local_path` fetch_repo mode for `replace foo =>
+// ../bar`-style local filesystem replacements: it copies the replacement
+// tree the same way moduleFromPath does, but checks the copied module's
+// own requirements against the parent workspace's go.sum, using the sumdb
+// only for requirements that go.sum does not list, matching how `cmd/go`
+// resolves filesystem replacements during `go mod download`.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+)
+
+// goSum indexes the records of a parsed go.sum file by "module version" and
+// "module version/go.mod".
+type goSum map[string]string
+
+func parseGoSum(data []byte) goSum {
+	sums := goSum{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		module, version, hash := fields[0], fields[1], fields[2]
+		sums[module+" "+version] = hash
+	}
+	return sums
+}
+
+// loadGoSum reads and indexes the go.sum at path. A missing file yields an
+// empty, always-missing index rather than an error: callers fall back to
+// sumdb verification for modules it doesn't cover.
+func loadGoSum(path string) goSum {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return goSum{}
+	}
+	return parseGoSum(data)
+}
+
+// localReplaceFromEnv and parentGoSumEnv name the environment variables
+// go_repository.bzl is expected to set to activate fetch_repo's -local_path
+// mode, forwarding the replace directive's target path and the parent
+// workspace's go.sum. This tree has no go_repository.bzl yet to pass
+// -local_path/-parent_go_sum flags through instead, so env vars are the
+// wiring available today; runGoModDownload reads them via
+// moduleFromLocalReplaceEnv.
+const (
+	localReplaceFromEnv = "GAZELLE_LOCAL_REPLACE_FROM"
+	parentGoSumEnv      = "GAZELLE_PARENT_GO_SUM"
+)
+
+// moduleFromLocalReplaceEnv resolves fetch_repo's -local_path mode from
+// $GAZELLE_LOCAL_REPLACE_FROM and $GAZELLE_PARENT_GO_SUM, copying the
+// replace target into dest. ok is false when GAZELLE_LOCAL_REPLACE_FROM
+// isn't set, in which case the caller should fall back to a normal proxy
+// download.
+func moduleFromLocalReplaceEnv(dest string) (ok bool, err error) {
+	from := os.Getenv(localReplaceFromEnv)
+	if from == "" {
+		return false, nil
+	}
+	return true, moduleFromLocalReplace(from, dest, os.Getenv(parentGoSumEnv))
+}
+
+// moduleFromLocalReplace implements fetch_repo's -local_path mode: it
+// copies the replace target at from into dest, then checks the go.mod of
+// each direct requirement in dest's go.mod against parentGoSumPath (the
+// go.sum of the workspace that declared the replace directive), falling
+// back to sumdb verification for anything the parent go.sum doesn't cover.
+// A mismatch with the parent go.sum is an error. Requirements marked
+// `// indirect` are skipped, and requirements of those requirements are not
+// followed. A requirement whose go.mod cannot be fetched, or that fails
+// sumdb verification, is reported as a warning and does not fail the call.
+//
+// Generating BUILD files rooted at dest is left to the caller: that needs
+// gazelle's language/go indexer, which isn't part of this package.
+func moduleFromLocalReplace(from, dest, parentGoSumPath string) error {
+	if err := copyTree(dest, from); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dest, "go.mod"))
+	if err != nil {
+		// No go.mod to resolve requirements for; the copy alone satisfies
+		// the replace.
+		return nil
+	}
+	f, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		return fmt.Errorf("parsing %s: %w", filepath.Join(dest, "go.mod"), err)
+	}
+
+	parentSums := loadGoSum(parentGoSumPath)
+	proxy := newModuleProxyClient()
+	sum := newSumDBVerifier()
+	for _, req := range f.Require {
+		if req.Indirect {
+			continue
+		}
+		modData, err := proxy.goMod(req.Mod.Path, req.Mod.Version)
+		if err != nil {
+			fmt.Printf("warning: could not resolve %s@%s: %v\n", req.Mod.Path, req.Mod.Version, err)
+			continue
+		}
+		if want, ok := parentSums[req.Mod.Path+" "+req.Mod.Version+"/go.mod"]; ok {
+			got, err := hashGoMod(modData)
+			if err != nil {
+				return err
+			}
+			if got != want {
+				return fmt.Errorf("%s@%s: go.mod hash %s does not match parent go.sum entry %s", req.Mod.Path, req.Mod.Version, got, want)
+			}
+			continue
+		}
+		if err := sum.verifyGoMod(req.Mod.Path, req.Mod.Version, modData); err != nil {
+			fmt.Printf("warning: %v\n", err)
+		}
+	}
+	return nil
+}
@@ -16,10 +16,11 @@ limitations under the License.
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"os/exec"
-	"strings"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/mod/modfile"
 )
 
 func moduleFromPath(from string, dest string) error {
@@ -28,20 +29,39 @@ func moduleFromPath(from string, dest string) error {
 		return err
 	}
 
-	cmd := exec.Command(findGoPath(), "mod", "download", "-json")
-	cmd.Dir = dest
-	cmd.Args = append(cmd.Args, "-modcacherw")
-
-	buf := &bytes.Buffer{}
-	bufErr := &bytes.Buffer{}
-	cmd.Stdout = buf
-	cmd.Stderr = bufErr
-	fmt.Printf("Running: %s %s\n", cmd.Path, strings.Join(cmd.Args, " "))
-	// TODO: handle errors
-	cmd.Run()
-
-	// if _, ok := dlErr.(*exec.ExitError); !ok {
-	// 	return fmt.Errorf("error running 'go mod download': %v", dlErr)
-	// }
+	// Warm the downloadCache with the go.mod files of the copied tree's own
+	// direct requirements. Unlike a bare `go mod download` run inside dest,
+	// this fetches no module zips and skips `// indirect` requirements.
+	// Failures here don't block the replace: they just mean a later,
+	// explicit go_repository fetch pays the cost instead.
+	data, err := os.ReadFile(filepath.Join(dest, "go.mod"))
+	if err != nil {
+		return nil
+	}
+	f, err := modfile.Parse("go.mod", data, nil)
+	if err != nil {
+		return nil
+	}
+	proxy := newModuleProxyClient()
+	sum := newSumDBVerifier()
+	cache := newDownloadCache()
+	for _, req := range f.Require {
+		if req.Indirect {
+			continue
+		}
+		if _, cached := cache.lookupGoMod(req.Mod.Path, req.Mod.Version); cached {
+			continue
+		}
+		modData, err := proxy.goMod(req.Mod.Path, req.Mod.Version)
+		if err != nil {
+			fmt.Printf("warning: could not resolve %s@%s: %v\n", req.Mod.Path, req.Mod.Version, err)
+			continue
+		}
+		if err := sum.verifyGoMod(req.Mod.Path, req.Mod.Version, modData); err != nil {
+			fmt.Printf("warning: %v\n", err)
+			continue
+		}
+		cache.storeGoMod(req.Mod.Path, req.Mod.Version, modData)
+	}
 	return nil
 }
@@ -0,0 +1,227 @@
+/* Copyright 2024 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/mod/sumdb"
+	"golang.org/x/mod/sumdb/dirhash"
+)
+
+// sumdbVerifier checks module zip and go.mod hashes against a checksum
+// database, the way `cmd/go` does when populating go.sum. It is disabled
+// (verify always succeeds) only when the module matches GONOSUMDB (or,
+// when that is unset, GONOSUMCHECK, then GOPRIVATE) or when GOSUMDB is
+// explicitly "off".
+// Anything else that leaves it unable to verify (e.g. an unknown sumdb
+// host with no embedded key) is a hard failure, not a silent downgrade.
+type sumdbVerifier struct {
+	env    goEnv
+	name   string
+	key    string
+	client *sumdb.Client
+
+	// failClosed is set when GOSUMDB named a host we have no key for.
+	// Verification isn't silently skipped in this case: every verify call
+	// fails instead of trusting the download.
+	failClosed bool
+}
+
+// sumdbOps implements sumdb.ClientOps by serving the database's key from
+// GOSUMDB (or knownGOSUMDB) and fetching lookups and tile data through a
+// GOPROXY, matching the "sumdb/<host>/..."
+// convention that proxy.golang.org uses to mirror a sumdb.
+type sumdbOps struct {
+	proxy *moduleProxyClient
+	name  string
+	key   string
+}
+
+// knownGOSUMDB embeds the public keys of well-known checksum databases, the
+// same way cmd/go/internal/modfetch does, so verification is on by default
+// even when GOSUMDB names a bare host with no "+<key>" suffix.
+var knownGOSUMDB = map[string]string{
+	"sum.golang.org": "sum.golang.org+033de0ae+Ac4zctda0e5eza+HJyk9SxEdh+s3Ux18htTTAD8OuAn8",
+}
+
+func newSumDBVerifier() *sumdbVerifier {
+	env := readGoEnv()
+	raw := env.sumdb
+	if raw == "" {
+		raw = "sum.golang.org"
+	}
+	name := strings.SplitN(raw, "+", 2)[0]
+	v := &sumdbVerifier{env: env, name: name, key: raw}
+	if name == "off" {
+		return v
+	}
+	if !strings.Contains(raw, "+") {
+		key, ok := knownGOSUMDB[name]
+		if !ok {
+			// We don't have this host's verifier key, so we can't safely
+			// trust downloads without it. Fail loudly rather than silently
+			// downgrading to no verification: callers that intend this
+			// should set GOSUMDB=off explicitly.
+			fmt.Printf("fetch_repo: GOSUMDB=%s has no known key; set GOSUMDB=%q+<key> or GOSUMDB=off\n", name, name)
+			v.name = "off"
+			v.failClosed = true
+			return v
+		}
+		v.key = key
+	}
+	ops := &sumdbOps{
+		proxy: newModuleProxyClient(),
+		name:  v.name,
+		key:   v.key,
+	}
+	v.client = sumdb.NewClient(ops)
+	return v
+}
+
+// shouldVerify reports whether importPath requires sumdb verification.
+func (v *sumdbVerifier) shouldVerify(importPath string) bool {
+	if v.client == nil || v.name == "off" {
+		return false
+	}
+	if v.env.nosumdb != "" && matchesGlobList(importPath, v.env.nosumdb) {
+		return false
+	}
+	return true
+}
+
+// checkFailClosed returns an error if sumdb verification is configured but
+// unusable (an unknown GOSUMDB host), instead of letting callers silently
+// treat that as "verification not required".
+func (v *sumdbVerifier) checkFailClosed(importPath string) error {
+	if !v.failClosed {
+		return nil
+	}
+	if v.env.nosumdb != "" && matchesGlobList(importPath, v.env.nosumdb) {
+		return nil
+	}
+	return fmt.Errorf("module %s: GOSUMDB=%s has no known key; refusing to download unverified (set GOSUMDB=off to disable verification)", importPath, v.env.sumdb)
+}
+
+// hashGoMod computes the go.sum-style h1: hash of a go.mod file's contents,
+// the same way `cmd/go` does for the "<module> <version>/go.mod" record.
+func hashGoMod(modData []byte) (string, error) {
+	return dirhash.Hash1([]string{"go.mod"}, func(string) (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(modData)), nil
+	})
+}
+
+// verifyGoMod checks modData (the go.mod contents) for importPath@version
+// against the sumdb, as `cmd/go` does before trusting a downloaded go.mod.
+func (v *sumdbVerifier) verifyGoMod(importPath, version string, modData []byte) error {
+	if !v.shouldVerify(importPath) {
+		return v.checkFailClosed(importPath)
+	}
+	want, err := hashGoMod(modData)
+	if err != nil {
+		return err
+	}
+	return v.checkLine(importPath, version, importPath+" "+version+"/go.mod "+want)
+}
+
+// verifyZip checks the module zip at zipPath for importPath@version
+// against the sumdb, as `cmd/go` does before trusting a downloaded module.
+func (v *sumdbVerifier) verifyZip(importPath, version, zipPath string) error {
+	if !v.shouldVerify(importPath) {
+		return v.checkFailClosed(importPath)
+	}
+	want, err := dirhash.HashZip(zipPath, dirhash.DefaultHash)
+	if err != nil {
+		return err
+	}
+	return v.checkLine(importPath, version, importPath+" "+version+" "+want)
+}
+
+// expectedZipSum looks up importPath@version's zip hash from the sumdb
+// ahead of downloading it, the way `cmd/go` consults go.sum before
+// fetching. Callers use this to check a content-addressable cache keyed by
+// that hash before downloading the zip; the lookup itself still queries the
+// sumdb over the network. ok is false when sumdb
+// verification isn't in effect for importPath (GOSUMDB=off, GONOSUMDB, or
+// a private module), in which case there's no trusted hash to key a cache
+// lookup on.
+func (v *sumdbVerifier) expectedZipSum(importPath, version string) (sum string, ok bool, err error) {
+	if !v.shouldVerify(importPath) {
+		return "", false, nil
+	}
+	prefix := importPath + " " + version + " "
+	lines, err := v.client.Lookup(importPath, version)
+	if err != nil {
+		return "", false, fmt.Errorf("module %s@%s: sumdb lookup: %w", importPath, version, err)
+	}
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimPrefix(line, prefix), true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func (v *sumdbVerifier) checkLine(importPath, version, want string) error {
+	lines, err := v.client.Lookup(importPath, version)
+	if err != nil {
+		return fmt.Errorf("module %s@%s: sumdb lookup: %w", importPath, version, err)
+	}
+	for _, line := range lines {
+		if line == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("module %s@%s: checksum mismatch: sumdb does not contain %q", importPath, version, want)
+}
+
+func (ops *sumdbOps) ReadConfig(file string) ([]byte, error) {
+	if file == "key" {
+		return []byte(ops.key), nil
+	}
+	if strings.HasSuffix(file, "/latest") {
+		// An empty result starts the client from an empty signed tree.
+		return []byte{}, nil
+	}
+	return nil, fmt.Errorf("sumdb: unknown config file %q", file)
+}
+
+func (ops *sumdbOps) WriteConfig(file string, old, new []byte) error {
+	// fetch_repo doesn't persist sumdb state between invocations; each run
+	// re-derives trust from the configured GOSUMDB key.
+	return nil
+}
+
+func (ops *sumdbOps) ReadCache(file string) ([]byte, error) {
+	return nil, os.ErrNotExist
+}
+
+func (ops *sumdbOps) WriteCache(file string, data []byte) {}
+
+func (ops *sumdbOps) Log(msg string) {}
+
+func (ops *sumdbOps) SecurityError(msg string) {}
+
+func (ops *sumdbOps) ReadRemote(path string) ([]byte, error) {
+	// proxy.golang.org (and compatible proxies) mirror the sumdb under the
+	// "sumdb/<name>/..." path prefix; reuse the module proxy client so the
+	// same GOPROXY fallback and auth rules apply.
+	return ops.proxy.get("sumdb/"+ops.name, strings.TrimPrefix(path, "/"+ops.name))
+}
@@ -0,0 +1,196 @@
+/* Copyright 2024 The Bazel Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// This file backs a `-vendor_dir` fetch_repo mode: when the parent module
+// has a populated vendor/ directory, it lets go_repository rules resolve
+// straight from vendor/modules.txt instead of downloading anything,
+// matching how `cmd/go` resolves modules under `-mod=vendor`.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vendoredModule is one `# module version` block of vendor/modules.txt,
+// together with the packages cmd/go recorded it provides and whether it's
+// a direct ("## explicit") requirement of the parent module.
+type vendoredModule struct {
+	Path     string
+	Version  string
+	Explicit bool
+	Packages []string
+
+	// ReplacementPath and ReplacementVersion record a `replace` directive
+	// applied to this module, parsed from a header of the form
+	// "# path version => newpath [newversion]". ReplacementVersion is
+	// empty for a replacement that points at a local filesystem path.
+	ReplacementPath    string
+	ReplacementVersion string
+}
+
+// parseModulesTxt parses the vendor/modules.txt format cmd/go writes:
+//
+//	# module version
+//	## explicit; go 1.19
+//	module/package/path
+//	module/package/path/sub
+//	# other/module v0.1.0
+//	other/module
+//
+// The "## explicit" marker records a direct requirement; modules without
+// it are present only to satisfy a direct dependency's own requirements.
+func parseModulesTxt(data []byte) ([]vendoredModule, error) {
+	var modules []vendoredModule
+	var cur *vendoredModule
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "# "):
+			fields := strings.Fields(strings.TrimPrefix(line, "# "))
+			// A module with a `replace` directive gets a header of the form
+			// "path version => newpath [newversion]"; a local filesystem
+			// replacement omits newversion.
+			if len(fields) >= 4 && fields[2] == "=>" {
+				mod := &vendoredModule{Path: fields[0], Version: fields[1], ReplacementPath: fields[3]}
+				if len(fields) == 5 {
+					mod.ReplacementVersion = fields[4]
+				} else if len(fields) != 4 {
+					return nil, fmt.Errorf("modules.txt: malformed module header %q", line)
+				}
+				if cur != nil {
+					modules = append(modules, *cur)
+				}
+				cur = mod
+				continue
+			}
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("modules.txt: malformed module header %q", line)
+			}
+			if cur != nil {
+				modules = append(modules, *cur)
+			}
+			cur = &vendoredModule{Path: fields[0], Version: fields[1]}
+		case strings.HasPrefix(line, "##"):
+			if cur == nil {
+				continue
+			}
+			for _, marker := range strings.Split(strings.TrimPrefix(line, "##"), ";") {
+				if strings.TrimSpace(marker) == "explicit" {
+					cur.Explicit = true
+				}
+			}
+		case strings.TrimSpace(line) == "":
+			continue
+		default:
+			if cur == nil {
+				return nil, fmt.Errorf("modules.txt: package line %q before any module header", line)
+			}
+			cur.Packages = append(cur.Packages, strings.TrimSpace(line))
+		}
+	}
+	if cur != nil {
+		modules = append(modules, *cur)
+	}
+	return modules, nil
+}
+
+// loadVendoredModules reads and parses <vendorDir>/modules.txt.
+func loadVendoredModules(vendorDir string) ([]vendoredModule, error) {
+	data, err := os.ReadFile(filepath.Join(vendorDir, "modules.txt"))
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", filepath.Join(vendorDir, "modules.txt"), err)
+	}
+	return parseModulesTxt(data)
+}
+
+// vendorRepo is the synthetic go_repository-shaped output for one vendored
+// module: instead of downloading anything, it points straight at the
+// subtree cmd/go already unpacked under vendor/.
+type vendorRepo struct {
+	ImportPath string
+	Version    string
+	Explicit   bool
+	Dir        string // vendorDir joined with ImportPath
+}
+
+// vendorRepositories resolves every module recorded in vendorDir's
+// modules.txt to a vendorRepo. It does not generate BUILD files for those
+// directories: that needs gazelle's language/go indexer, which this
+// package doesn't have.
+//
+// A module that lists no packages is only present to satisfy some other
+// module's go.mod requirements under module-graph pruning; `go mod vendor`
+// doesn't create a directory for it, so only modules with at least one
+// vendored package are required to exist on disk.
+func vendorRepositories(vendorDir string) ([]vendorRepo, error) {
+	mods, err := loadVendoredModules(vendorDir)
+	if err != nil {
+		return nil, err
+	}
+	repos := make([]vendorRepo, 0, len(mods))
+	for _, mod := range mods {
+		dir := filepath.Join(vendorDir, filepath.FromSlash(mod.Path))
+		if len(mod.Packages) > 0 {
+			if _, err := os.Stat(dir); err != nil {
+				return nil, fmt.Errorf("module %s@%s: %s not found under %s", mod.Path, mod.Version, mod.Path, vendorDir)
+			}
+		}
+		repos = append(repos, vendorRepo{
+			ImportPath: mod.Path,
+			Version:    mod.Version,
+			Explicit:   mod.Explicit,
+			Dir:        dir,
+		})
+	}
+	return repos, nil
+}
+
+// vendorDirEnv names the environment variable go_repository.bzl is expected
+// to set to the parent workspace's vendor/ directory, activating
+// fetch_repo's -vendor_dir mode. This tree has no go_repository.bzl yet to
+// pass a -vendor_dir flag through instead, so an env var is the wiring
+// available today; runGoModDownload reads it via moduleFromVendorEnv.
+const vendorDirEnv = "GAZELLE_VENDOR_DIR"
+
+// moduleFromVendorEnv resolves importpath@version against
+// $GAZELLE_VENDOR_DIR's modules.txt and copies its vendored tree into dest,
+// instead of fetching it from a proxy. ok is false when GAZELLE_VENDOR_DIR
+// isn't set or doesn't list importpath@version, in which case the caller
+// should fall back to a normal proxy download.
+func moduleFromVendorEnv(dest, importpath, version string) (ok bool, err error) {
+	vendorDir := os.Getenv(vendorDirEnv)
+	if vendorDir == "" {
+		return false, nil
+	}
+	repos, err := vendorRepositories(vendorDir)
+	if err != nil {
+		return false, err
+	}
+	for _, repo := range repos {
+		if repo.ImportPath == importpath && repo.Version == version {
+			if err := copyTree(dest, repo.Dir); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
+	}
+	return false, nil
+}